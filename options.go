@@ -0,0 +1,157 @@
+package git
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+var (
+	ErrMissingURL                   = errors.New("URL field is required")
+	ErrMissingRefSpecs              = errors.New("RefSpecs field is required")
+	ErrUnshallowConflictsWithDeepen = errors.New("Unshallow cannot be used together with Deepen, ShallowSince or ShallowExclude")
+)
+
+// FetchOptions describes how a fetch should be performed.
+type FetchOptions struct {
+	// RefSpecs specify what destination ref to fetch to base on the given
+	// remote ref, where fetch will store the fetched objects.
+	RefSpecs []config.RefSpec
+	// Depth limit fetching to the specified number of commits from the tip
+	// of each remote branch history. It only has an effect on a repository
+	// that isn't already shallow; to deepen one, use Deepen instead.
+	Depth int
+	// Deepen extends an already shallow repository by the given number of
+	// commits beyond its current shallow boundary. It is a no-op on a
+	// repository that isn't shallow yet.
+	Deepen int
+	// Unshallow requests the full history of a shallow repository,
+	// removing its shallow boundary entirely.
+	Unshallow bool
+	// ShallowSince deepens a shallow repository so that it contains all
+	// reachable commits after the given date.
+	ShallowSince time.Time
+	// ShallowExclude deepens a shallow repository so that it contains all
+	// reachable commits except those reachable from the given revisions.
+	ShallowExclude []string
+	// Auth credentials, if required, to use with the remote repository.
+	Auth transport.AuthMethod
+	// Progress is where the human readable information sent by the server
+	// is stored, if nil nothing is stored and the capability (if supported)
+	// no-progress, is sent to the server to avoid send this information.
+	Progress io.Writer
+	// RetryPolicy controls whether a transient failure while connecting to
+	// or transferring data from the remote is retried, and how long to
+	// wait between attempts. If nil, failures are returned to the caller
+	// immediately, as before.
+	RetryPolicy RetryPolicy
+	// ProgressReporter, if set, receives structured progress events parsed
+	// out of the server's sideband-2 progress messages, in addition to the
+	// raw text still written to Progress.
+	ProgressReporter ProgressReporter
+}
+
+// Validate validates the fields and sets the default values.
+func (o *FetchOptions) Validate() error {
+	if len(o.RefSpecs) == 0 {
+		o.RefSpecs = []config.RefSpec{"refs/heads/*:refs/remotes/origin/*"}
+	}
+
+	for _, r := range o.RefSpecs {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.Unshallow && (o.Deepen != 0 || !o.ShallowSince.IsZero() || len(o.ShallowExclude) != 0) {
+		return ErrUnshallowConflictsWithDeepen
+	}
+
+	return nil
+}
+
+// PushOptions describes how a push should be performed.
+type PushOptions struct {
+	// RemoteName is the name of the remote to push to, defaults to "origin".
+	RemoteName string
+	// RefSpecs specify what destination ref to update with what source
+	// object. A Force value of true causes the corresponding RefSpec to
+	// ignore the fast-forward check.
+	RefSpecs []config.RefSpec
+	// Auth credentials, if required, to use with the remote repository.
+	Auth transport.AuthMethod
+	// Progress is currently unused for Push: ReceivePackSession doesn't
+	// expose a stream of the server's progress messages the way
+	// UploadPackSession does for Fetch, so there is nothing to write to it
+	// yet. The field is kept for API symmetry with FetchOptions.
+	Progress io.Writer
+	// Force allows updating a remote ref even when it isn't a fast-forward
+	// of the ref it's replacing, for every RefSpec that doesn't already
+	// request a force update.
+	Force bool
+	// RetryPolicy controls whether a transient failure while connecting to
+	// or transferring data to the remote is retried, and how long to wait
+	// between attempts. If nil, failures are returned to the caller
+	// immediately, as before.
+	RetryPolicy RetryPolicy
+	// ProgressReporter is currently unused for Push, for the same reason as
+	// Progress above.
+	ProgressReporter ProgressReporter
+}
+
+// Validate validates the fields and sets the default values.
+func (o *PushOptions) Validate() error {
+	if len(o.RefSpecs) == 0 {
+		return ErrMissingRefSpecs
+	}
+
+	for _, r := range o.RefSpecs {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PushResult reports, for every ref updated by a Push, the error the remote
+// returned for it (nil on success).
+type PushResult struct {
+	Status map[string]error
+}
+
+// CloneOptions describes how a clone should be performed.
+type CloneOptions struct {
+	// URL to clone.
+	URL string
+	// Auth credentials, if required, to use with the remote repository.
+	Auth transport.AuthMethod
+	// RemoteName, the default is "origin".
+	RemoteName string
+	// Depth limits fetching to the specified number of commits.
+	Depth int
+	// Progress is where the human readable information sent by the server
+	// is stored, if nil nothing is stored.
+	Progress io.Writer
+	// RetryPolicy controls whether a transient failure while connecting to
+	// or transferring data from the remote is retried, and how long to
+	// wait between attempts. If nil, failures are returned to the caller
+	// immediately.
+	RetryPolicy RetryPolicy
+}
+
+// Validate validates the fields and sets the default values.
+func (o *CloneOptions) Validate() error {
+	if o.URL == "" {
+		return ErrMissingURL
+	}
+
+	if o.RemoteName == "" {
+		o.RemoteName = "origin"
+	}
+
+	return nil
+}
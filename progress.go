@@ -0,0 +1,158 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// ProgressReporter receives structured events parsed out of the progress
+// messages a server sends over the sideband-2 channel while a fetch is in
+// flight; Push does not report to it. Implementations should return quickly, since the
+// callbacks run on the goroutine copying the transport's response.
+//
+// Any of the methods may be left as a no-op embedding *NopProgressReporter;
+// a caller only interested in, say, OnRefUpdate doesn't have to implement
+// the rest.
+type ProgressReporter interface {
+	// OnCounting reports object counting progress as done objects out of
+	// total. This takes (done, total) rather than a single running count,
+	// because that's what the server's "Counting objects: N% (done/total)"
+	// line actually carries on the wire.
+	OnCounting(done, total int)
+	// OnCompressing reports compression progress as done objects out of
+	// total.
+	OnCompressing(objects, total int)
+	// OnReceiving reports packfile transfer progress, in bytes received
+	// out of the total advertised by the server (total is 0 if unknown).
+	OnReceiving(bytes, total int64)
+	// OnResolvingDeltas reports delta resolution progress as done deltas
+	// out of total.
+	OnResolvingDeltas(done, total int)
+	// OnRefUpdate is called once per local reference Fetch updates, after
+	// the update has been persisted to the Storer.
+	OnRefUpdate(name plumbing.ReferenceName, old, new plumbing.Hash)
+}
+
+// NopProgressReporter is a ProgressReporter whose methods all do nothing,
+// meant to be embedded by callers that only care about a subset of events.
+type NopProgressReporter struct{}
+
+func (*NopProgressReporter) OnCounting(done, total int)        {}
+func (*NopProgressReporter) OnCompressing(objects, total int)  {}
+func (*NopProgressReporter) OnReceiving(bytes, total int64)    {}
+func (*NopProgressReporter) OnResolvingDeltas(done, total int) {}
+func (*NopProgressReporter) OnRefUpdate(name plumbing.ReferenceName, old, new plumbing.Hash) {
+}
+
+var (
+	countingRe    = regexp.MustCompile(`^Counting objects:\s+\d+% \((\d+)/(\d+)\)`)
+	compressingRe = regexp.MustCompile(`^Compressing objects:\s+\d+% \((\d+)/(\d+)\)`)
+	receivingRe   = regexp.MustCompile(`^Receiving objects:\s+\d+% \(\d+/\d+\)(?:, ([\d.]+) (bytes|KiB|MiB|GiB|TiB))?`)
+	resolvingRe   = regexp.MustCompile(`^Resolving deltas:\s+\d+% \((\d+)/(\d+)\)`)
+
+	byteUnitScale = map[string]int64{
+		"bytes": 1,
+		"KiB":   1024,
+		"MiB":   1024 * 1024,
+		"GiB":   1024 * 1024 * 1024,
+		"TiB":   1024 * 1024 * 1024 * 1024,
+	}
+)
+
+// progressParsingWriter is an io.Writer that sits in front of the raw
+// progress text a server sends over the sideband-2 channel. It forwards
+// every byte it sees, unmodified, to w (for backward compatibility with
+// callers that only want the human readable text), while additionally
+// parsing complete lines and reporting them as typed events to reporter.
+//
+// The underlying transport already separates the sideband-2 progress
+// channel from the packfile data, so everything written here is progress
+// text, not pack content.
+type progressParsingWriter struct {
+	w        io.Writer
+	reporter ProgressReporter
+	buf      []byte
+}
+
+func newProgressParsingWriter(w io.Writer, reporter ProgressReporter) *progressParsingWriter {
+	return &progressParsingWriter{w: w, reporter: reporter}
+}
+
+func (p *progressParsingWriter) Write(b []byte) (int, error) {
+	if p.w != nil {
+		if _, err := p.w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	if p.reporter == nil {
+		return len(b), nil
+	}
+
+	p.buf = append(p.buf, b...)
+
+	for {
+		// Progress lines are \r-updated until they're done, at which point
+		// the server terminates them with \n; either is a complete line.
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+
+		p.parseLine(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+func (p *progressParsingWriter) parseLine(line string) {
+	if m := countingRe.FindStringSubmatch(line); m != nil {
+		p.reporter.OnCounting(atoi(m[1]), atoi(m[2]))
+		return
+	}
+
+	if m := compressingRe.FindStringSubmatch(line); m != nil {
+		p.reporter.OnCompressing(atoi(m[1]), atoi(m[2]))
+		return
+	}
+
+	if m := receivingRe.FindStringSubmatch(line); m != nil {
+		// The server never advertises a total byte count on this line, only
+		// the running total received so far, so total is always 0 (unknown)
+		// here, same as OnReceiving documents.
+		p.reporter.OnReceiving(parseHumanBytes(m[1], m[2]), 0)
+		return
+	}
+
+	if m := resolvingRe.FindStringSubmatch(line); m != nil {
+		p.reporter.OnResolvingDeltas(atoi(m[1]), atoi(m[2]))
+		return
+	}
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// parseHumanBytes converts a human-readable size like "512" bytes or "1.50"
+// MiB, as git's progress output formats it, to a plain byte count. It
+// returns 0 if value is empty, as it is on a "Receiving objects" line that
+// hasn't reported a size yet.
+func parseHumanBytes(value, unit string) int64 {
+	if value == "" {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+
+	return int64(f * float64(byteUnitScale[unit]))
+}
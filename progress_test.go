@@ -0,0 +1,83 @@
+package git
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProgressSuite struct{}
+
+var _ = Suite(&ProgressSuite{})
+
+type recordingProgressEvents struct {
+	NopProgressReporter
+	counting         []int
+	countingTotal    []int
+	compressing      []int
+	compressingTotal []int
+	receiving        []int64
+	receivingTotal   []int64
+	resolvingDeltas  []int
+	resolvingTotal   []int
+}
+
+func (r *recordingProgressEvents) OnCounting(done, total int) {
+	r.counting = append(r.counting, done)
+	r.countingTotal = append(r.countingTotal, total)
+}
+
+func (r *recordingProgressEvents) OnCompressing(done, total int) {
+	r.compressing = append(r.compressing, done)
+	r.compressingTotal = append(r.compressingTotal, total)
+}
+
+func (r *recordingProgressEvents) OnReceiving(done, total int64) {
+	r.receiving = append(r.receiving, done)
+	r.receivingTotal = append(r.receivingTotal, total)
+}
+
+func (r *recordingProgressEvents) OnResolvingDeltas(done, total int) {
+	r.resolvingDeltas = append(r.resolvingDeltas, done)
+	r.resolvingTotal = append(r.resolvingTotal, total)
+}
+
+func (s *ProgressSuite) TestParseLines(c *C) {
+	reporter := &recordingProgressEvents{}
+	w := newProgressParsingWriter(nil, reporter)
+
+	lines := "" +
+		"Counting objects: 50% (2/4)\r" +
+		"Counting objects: 100% (4/4), done.\n" +
+		"Compressing objects: 100% (3/3), done.\n" +
+		"Receiving objects: 100% (4/4), 512 bytes | 0 bytes/s, done.\n" +
+		"Resolving deltas: 100% (1/1), done.\n"
+
+	_, err := w.Write([]byte(lines))
+	c.Assert(err, IsNil)
+
+	c.Assert(reporter.counting, DeepEquals, []int{2, 4})
+	c.Assert(reporter.countingTotal, DeepEquals, []int{4, 4})
+	c.Assert(reporter.compressing, DeepEquals, []int{3})
+	c.Assert(reporter.compressingTotal, DeepEquals, []int{3})
+	c.Assert(reporter.receiving, DeepEquals, []int64{512})
+	c.Assert(reporter.receivingTotal, DeepEquals, []int64{0})
+	c.Assert(reporter.resolvingDeltas, DeepEquals, []int{1})
+	c.Assert(reporter.resolvingTotal, DeepEquals, []int{1})
+}
+
+func (s *ProgressSuite) TestParseHumanBytes(c *C) {
+	c.Assert(parseHumanBytes("512", "bytes"), Equals, int64(512))
+	c.Assert(parseHumanBytes("1.50", "KiB"), Equals, int64(1536))
+	c.Assert(parseHumanBytes("2", "MiB"), Equals, int64(2*1024*1024))
+	c.Assert(parseHumanBytes("", "bytes"), Equals, int64(0))
+}
+
+func (s *ProgressSuite) TestWriteForwardsRawText(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := newProgressParsingWriter(buf, &NopProgressReporter{})
+
+	_, err := w.Write([]byte("Counting objects: 100% (1/1), done.\n"))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "Counting objects: 100% (1/1), done.\n")
+}
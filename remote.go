@@ -0,0 +1,695 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+)
+
+// NoErrAlreadyUpToDate is returned by Fetch and Push when the remote has no
+// new objects or refs to transfer.
+var NoErrAlreadyUpToDate = errors.New("already up-to-date")
+
+// ErrForceNeeded is returned by Push when a RefSpec update is not a
+// fast-forward and neither RefSpec nor PushOptions.Force request one.
+var ErrForceNeeded = errors.New("some refs were not updated")
+
+// ErrShallowNotSupported is returned by Fetch when FetchOptions requests a
+// shallow operation (Depth, Deepen, Unshallow, ShallowSince or
+// ShallowExclude) against a Storer that cannot persist a shallow boundary.
+var ErrShallowNotSupported = errors.New("storer does not support shallow repositories")
+
+// Remote represents a connection to a remote repository.
+type Remote struct {
+	c *config.RemoteConfig
+	s Storer
+	p io.Writer
+
+	ar *packp.AdvRefs
+}
+
+func newRemote(s Storer, w io.Writer, c *config.RemoteConfig) *Remote {
+	return &Remote{s: s, p: w, c: c}
+}
+
+// Config returns the RemoteConfig object used to instantiate this Remote.
+func (r *Remote) Config() *config.RemoteConfig {
+	return r.c
+}
+
+func (r *Remote) String() string {
+	var fetch, push string
+	if len(r.c.URL) > 0 {
+		fetch, push = r.c.URL, r.c.URL
+	}
+
+	return fmt.Sprintf("%s\t%s (fetch)\n%s\t%s (push)", r.c.Name, fetch, r.c.Name, push)
+}
+
+// Connect opens a new session against the remote and retrieves its
+// advertised references.
+func (r *Remote) Connect() error {
+	return r.ConnectWithRetry(nil)
+}
+
+// ConnectWithRetry is like Connect, but retries a transient failure to
+// reach the remote according to policy. A nil policy behaves like Connect.
+func (r *Remote) ConnectWithRetry(policy RetryPolicy) error {
+	ep, err := transport.NewEndpoint(r.c.URL)
+	if err != nil {
+		return err
+	}
+
+	var ar *packp.AdvRefs
+	err = withRetry(context.Background(), policy, func() error {
+		var err error
+		ar, err = r.advertisedReferences(ep)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	r.ar = ar
+	return nil
+}
+
+func (r *Remote) advertisedReferences(ep transport.Endpoint) (*packp.AdvRefs, error) {
+	cl, err := client.NewClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := cl.NewUploadPackSession(ep, r.c.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+
+	return s.AdvertisedReferences()
+}
+
+// AdvertisedReferences returns the references advertised by the remote on
+// the last call to Connect, Fetch or Push. It returns nil if none of them
+// has succeeded yet.
+func (r *Remote) AdvertisedReferences() *packp.AdvRefs {
+	return r.ar
+}
+
+// Capabilities returns the capability.List advertised by the remote.
+func (r *Remote) Capabilities() *capability.List {
+	if r.ar == nil {
+		return nil
+	}
+
+	return r.ar.Capabilities
+}
+
+// Head returns the reference pointed to by HEAD on the remote.
+func (r *Remote) Head() *plumbing.Reference {
+	ref, err := r.Reference(plumbing.HEAD, true)
+	if err != nil {
+		return nil
+	}
+
+	return ref
+}
+
+// Reference resolves a reference from the set advertised by the remote. If
+// resolved is true symbolic references are resolved to their target.
+func (r *Remote) Reference(name plumbing.ReferenceName, resolved bool) (*plumbing.Reference, error) {
+	if r.ar == nil {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+
+	if !resolved {
+		ref, ok := r.ar.References[name.String()]
+		if !ok {
+			return nil, plumbing.ErrReferenceNotFound
+		}
+
+		return plumbing.NewReferenceFromStrings(name.String(), ref.String()), nil
+	}
+
+	return storer.ResolveReference(r.referenceStorer(), name)
+}
+
+// References returns an iterator over the references advertised by the
+// remote.
+func (r *Remote) References() (storer.ReferenceIter, error) {
+	return r.referenceStorer().IterReferences()
+}
+
+func (r *Remote) referenceStorer() storer.ReferenceStorer {
+	return r.ar.AsReferenceStorer()
+}
+
+// Fetch fetches references along with the objects necessary to complete
+// their histories, from the remote.
+func (r *Remote) Fetch(o *FetchOptions) error {
+	return r.fetch(context.Background(), o)
+}
+
+func (r *Remote) fetch(ctx context.Context, o *FetchOptions) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	ep, err := transport.NewEndpoint(r.c.URL)
+	if err != nil {
+		return err
+	}
+
+	cl, err := client.NewClient(ep)
+	if err != nil {
+		return err
+	}
+
+	// The whole exchange, negotiation and transfer alike, runs inside a
+	// single retry loop: a session that's died mid-transfer (an SSH EOF,
+	// say) is just as dead for a retried UploadPack call as one that died
+	// during negotiation, so every attempt closes it and starts over with a
+	// fresh session and a freshly negotiated request.
+	var (
+		s                transport.UploadPackSession
+		ar               *packp.AdvRefs
+		req              *packp.UploadPackRequest
+		shallow          storer.ShallowStorer
+		shallowRequested bool
+		unshallow        bool
+		reader           io.ReadCloser
+		upToDate         bool
+	)
+	err = withRetry(ctx, o.RetryPolicy, func() error {
+		if s != nil {
+			s.Close()
+		}
+
+		var err error
+		s, err = cl.NewUploadPackSession(ep, o.Auth)
+		if err != nil {
+			return err
+		}
+
+		ar, err = s.AdvertisedReferences()
+		if err != nil {
+			return err
+		}
+
+		req = packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+		if r.progressWriter(o.Progress, o.ProgressReporter) == nil && ar.Capabilities.Supports(capability.NoProgress) {
+			if err := req.Capabilities.Set(capability.NoProgress); err != nil {
+				return err
+			}
+		}
+
+		haves, err := r.wantedReferences(ar, o, req)
+		if err != nil {
+			return err
+		}
+
+		shallow, shallowRequested, unshallow, err = r.prepareShallow(req, o)
+		if err != nil {
+			return err
+		}
+
+		if !haves && req.Depth == nil {
+			upToDate = true
+			return nil
+		}
+
+		reader, err = s.UploadPack(ctx, req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	r.ar = ar
+
+	if upToDate {
+		return NoErrAlreadyUpToDate
+	}
+	defer reader.Close()
+
+	body := io.Reader(reader)
+	if pw := r.progressWriter(o.Progress, o.ProgressReporter); pw != nil {
+		body = io.TeeReader(reader, pw)
+	}
+
+	if err := r.writePack(body); err != nil {
+		return err
+	}
+
+	if shallowRequested {
+		var newBoundary []plumbing.Hash
+		if !unshallow {
+			newBoundary, err = r.shallowBoundary(r.matchedReferenceHashes(ar, o))
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := shallow.SetShallow(newBoundary); err != nil {
+			return err
+		}
+	}
+
+	return r.updateLocalReferences(ar, o)
+}
+
+// matchedReferenceHashes returns the hash every reference advertised by the
+// remote and matched by o.RefSpecs points at, regardless of whether the
+// object was already present locally (unlike wantedReferences, which only
+// reports the ones that still needed fetching).
+func (r *Remote) matchedReferenceHashes(ar *packp.AdvRefs, o *FetchOptions) []plumbing.Hash {
+	var hashes []plumbing.Hash
+	for name, hash := range ar.References {
+		ref := plumbing.NewReferenceFromStrings(name, hash.String())
+
+		for _, rs := range o.RefSpecs {
+			if rs.Match(ref.Name()) {
+				hashes = append(hashes, ref.Hash())
+				break
+			}
+		}
+	}
+
+	return hashes
+}
+
+// shallowBoundary walks the commit graph back from each of tips and returns
+// every commit reached whose parents are not (all) present locally — the
+// shallow boundary the just-completed fetch actually produced. This can't
+// be approximated from the UploadPackRequest's Wants: wantedReferences
+// skips any ref whose tip is already present locally, which on a Deepen (or
+// ShallowSince/ShallowExclude) of an already-shallow repository is every
+// ref, leaving Wants empty even though the boundary moved.
+func (r *Remote) shallowBoundary(tips []plumbing.Hash) ([]plumbing.Hash, error) {
+	var boundary []plumbing.Hash
+	seen := make(map[plumbing.Hash]bool)
+	pending := append([]plumbing.Hash(nil), tips...)
+
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		c, err := object.GetCommit(r.s, h)
+		if err != nil {
+			return nil, err
+		}
+
+		missingParent := false
+		for _, p := range c.ParentHashes {
+			if _, err := r.s.EncodedObject(plumbing.CommitObject, p); err != nil {
+				missingParent = true
+				continue
+			}
+
+			pending = append(pending, p)
+		}
+
+		if missingParent {
+			boundary = append(boundary, h)
+		}
+	}
+
+	return boundary, nil
+}
+
+func (r *Remote) wantedReferences(ar *packp.AdvRefs, o *FetchOptions, req *packp.UploadPackRequest) (bool, error) {
+	wanted := false
+	for name, hash := range ar.References {
+		ref := plumbing.NewReferenceFromStrings(name, hash.String())
+
+		matched := false
+		for _, rs := range o.RefSpecs {
+			if rs.Match(ref.Name()) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		if _, err := r.s.EncodedObject(plumbing.AnyObject, ref.Hash()); err == nil {
+			continue
+		}
+
+		req.Wants = append(req.Wants, ref.Hash())
+		wanted = true
+	}
+
+	return wanted, nil
+}
+
+// prepareShallow loads the repository's current shallow boundary (if any)
+// into req.Shallows and, depending on o, sets req.Depth so the server knows
+// how (or whether) to truncate history: Unshallow asks for the full history
+// and clears the boundary, while Deepen/ShallowSince/ShallowExclude/Depth
+// request a (further) truncated history with a new boundary. Either way,
+// the new boundary is only persisted by the caller once the matching
+// objects have actually been fetched (reported back via the needsPersist
+// and unshallow return values) — never eagerly here, since a transfer
+// failure after that point must leave the on-disk boundary untouched.
+func (r *Remote) prepareShallow(req *packp.UploadPackRequest, o *FetchOptions) (shallow storer.ShallowStorer, needsPersist, unshallow bool, err error) {
+	shallowOptsUsed := o.Unshallow || o.Depth != 0 || o.Deepen != 0 || !o.ShallowSince.IsZero() || len(o.ShallowExclude) != 0
+
+	shallow, ok := r.s.(storer.ShallowStorer)
+	if !ok {
+		if shallowOptsUsed {
+			return nil, false, false, ErrShallowNotSupported
+		}
+
+		return nil, false, false, nil
+	}
+
+	boundary, err := shallow.Shallow()
+	if err != nil {
+		return nil, false, false, err
+	}
+	req.Shallows = boundary
+
+	switch {
+	case o.Unshallow:
+		req.Depth = packp.DepthCommits(0)
+		return shallow, true, true, nil
+	case o.Deepen != 0 && len(boundary) != 0:
+		req.Depth = packp.DepthCommits(o.Deepen)
+	case !o.ShallowSince.IsZero():
+		req.Depth = packp.DepthSince(o.ShallowSince)
+	case len(o.ShallowExclude) != 0:
+		excl := make([]plumbing.Hash, len(o.ShallowExclude))
+		for i, rev := range o.ShallowExclude {
+			excl[i] = plumbing.NewHash(rev)
+		}
+		req.Depth = packp.DepthNot(excl)
+	case o.Depth != 0 && len(boundary) == 0:
+		req.Depth = packp.DepthCommits(o.Depth)
+	}
+
+	return shallow, req.Depth != nil, false, nil
+}
+
+// progressWriter combines the progress destination configured on the
+// Remote itself (r.p, set at construction time) with the one set on the
+// current operation's options, if any, and wraps the result so that
+// reporter (if non-nil) also gets structured events parsed out of the
+// text. It returns nil if there is nowhere to send progress at all.
+func (r *Remote) progressWriter(optsProgress io.Writer, reporter ProgressReporter) io.Writer {
+	var w io.Writer
+	switch {
+	case r.p != nil && optsProgress != nil:
+		w = io.MultiWriter(r.p, optsProgress)
+	case r.p != nil:
+		w = r.p
+	case optsProgress != nil:
+		w = optsProgress
+	}
+
+	if reporter == nil {
+		return w
+	}
+
+	return newProgressParsingWriter(w, reporter)
+}
+
+func (r *Remote) writePack(reader io.Reader) error {
+	w, ok := r.s.(storer.PackfileWriter)
+	if !ok {
+		p, err := packfile.UpdateObjectStorage(r.s, reader)
+		_ = p
+		return err
+	}
+
+	writer, err := w.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+func (r *Remote) updateLocalReferences(ar *packp.AdvRefs, o *FetchOptions) error {
+	for name, hash := range ar.References {
+		ref := plumbing.NewReferenceFromStrings(name, hash.String())
+
+		for _, rs := range o.RefSpecs {
+			if !rs.Match(ref.Name()) {
+				continue
+			}
+
+			dst := rs.Dst(ref.Name())
+			old, _ := r.s.Reference(dst)
+
+			local := plumbing.NewHashReference(dst, ref.Hash())
+			if err := r.s.SetReference(local); err != nil {
+				return err
+			}
+
+			if o.ProgressReporter != nil {
+				oldHash := plumbing.ZeroHash
+				if old != nil {
+					oldHash = old.Hash()
+				}
+
+				o.ProgressReporter.OnRefUpdate(dst, oldHash, ref.Hash())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Push pushes references along with the objects necessary to complete their
+// histories, to the remote repository.
+//
+// It negotiates a send-pack session over the same transport used for
+// fetching, builds the command list from the configured RefSpecs, streams
+// a packfile of the objects the remote is missing, and returns a PushResult
+// reporting the status the remote gave back for each updated ref.
+func (r *Remote) Push(o *PushOptions) (*PushResult, error) {
+	return r.push(context.Background(), o)
+}
+
+func (r *Remote) push(ctx context.Context, o *PushOptions) (*PushResult, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	ep, err := transport.NewEndpoint(r.c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := client.NewClient(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	// As with fetch, negotiation and transfer run inside a single retry
+	// loop: once the session has died mid-transfer, retrying ReceivePack on
+	// that same session just fails again immediately, so every attempt
+	// closes it and starts over with a fresh session, a freshly negotiated
+	// request and a fresh packfile pipe (neither the old session's pipe nor
+	// its feeder goroutine are reusable once a ReceivePack attempt fails).
+	var (
+		s        transport.ReceivePackSession
+		ar       *packp.AdvRefs
+		cmds     []*packp.Command
+		req      *packp.ReferenceUpdateRequest
+		pipeR    *io.PipeReader
+		report   *packp.ReportStatus
+		upToDate bool
+	)
+	err = withRetry(ctx, o.RetryPolicy, func() error {
+		if s != nil {
+			s.Close()
+		}
+		if pipeR != nil {
+			pipeR.Close()
+		}
+
+		var err error
+		s, err = cl.NewReceivePackSession(ep, o.Auth)
+		if err != nil {
+			return err
+		}
+
+		ar, err = s.AdvertisedReferences()
+		if err != nil {
+			return err
+		}
+
+		var wants, haves []plumbing.Hash
+		cmds, wants, haves, err = r.buildPushCommands(ar.AsReferenceStorer(), o)
+		if err != nil {
+			return err
+		}
+
+		if len(cmds) == 0 {
+			upToDate = true
+			return nil
+		}
+
+		req = packp.NewReferenceUpdateRequestFromCapabilities(ar.Capabilities)
+		req.Commands = cmds
+
+		var pipeW *io.PipeWriter
+		pipeR, pipeW = io.Pipe()
+		go func() {
+			pipeW.CloseWithError(r.encodePackfile(pipeW, wants, haves))
+		}()
+
+		// o.Progress/o.ProgressReporter aren't wired up here: pipeR is the
+		// outgoing packfile we're generating, not anything the server sends
+		// back, and ReceivePackSession doesn't give us a way to read the
+		// server's side of the conversation.
+		req.Packfile = ioutil.NopCloser(pipeR)
+
+		report, err = s.ReceivePack(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	r.ar = ar
+
+	if upToDate {
+		return nil, NoErrAlreadyUpToDate
+	}
+
+	return r.newPushResult(report, cmds)
+}
+
+// buildPushCommands computes the old/new hash pairs that need to be sent to
+// the remote for every local ref matched by o.RefSpecs, the set of object
+// hashes the remote is being asked to have afterwards (wants), and the set
+// of hashes it already has (haves, the non-zero old side of each command) —
+// the latter lets encodePackfile send only the objects the remote is
+// missing instead of its whole reachable history.
+func (r *Remote) buildPushCommands(remoteRefs storer.ReferenceStorer, o *PushOptions) (cmds []*packp.Command, wants, haves []plumbing.Hash, err error) {
+	localRefs, err := r.s.IterReferences()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = localRefs.ForEach(func(ref *plumbing.Reference) error {
+		for _, rs := range o.RefSpecs {
+			if !rs.Match(ref.Name()) {
+				continue
+			}
+
+			dst := rs.Dst(ref.Name())
+			old, _ := remoteRefs.Reference(dst)
+
+			oldHash := plumbing.ZeroHash
+			if old != nil {
+				oldHash = old.Hash()
+			}
+
+			if oldHash == ref.Hash() {
+				continue
+			}
+
+			if !o.Force && !rs.IsForceUpdate() && old != nil {
+				if !r.isFastForward(oldHash, ref.Hash()) {
+					return ErrForceNeeded
+				}
+			}
+
+			cmds = append(cmds, &packp.Command{
+				Name: dst,
+				Old:  oldHash,
+				New:  ref.Hash(),
+			})
+			wants = append(wants, ref.Hash())
+			if oldHash != plumbing.ZeroHash {
+				haves = append(haves, oldHash)
+			}
+		}
+
+		return nil
+	})
+
+	return cmds, wants, haves, err
+}
+
+// isFastForward reports whether old is an ancestor of new, by walking the
+// commit graph from new looking for it.
+func (r *Remote) isFastForward(old, new plumbing.Hash) bool {
+	c, err := object.GetCommit(r.s, new)
+	if err != nil {
+		return false
+	}
+
+	found := false
+	iter := object.NewCommitPreorderIter(c, nil, nil)
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash != old {
+			return nil
+		}
+
+		found = true
+		return storer.ErrStop
+	})
+	if err != nil {
+		return false
+	}
+
+	return found
+}
+
+func (r *Remote) encodePackfile(w io.WriteCloser, wants, haves []plumbing.Hash) error {
+	objs, err := revlist.Objects(r.s, wants, haves)
+	if err != nil {
+		return err
+	}
+
+	e := packfile.NewEncoder(w, r.s, false)
+	_, err = e.Encode(objs, 10)
+	return err
+}
+
+func (r *Remote) newPushResult(report *packp.ReportStatus, cmds []*packp.Command) (*PushResult, error) {
+	result := &PushResult{Status: make(map[string]error, len(cmds))}
+
+	for _, cs := range report.CommandStatuses {
+		var err error
+		if !cs.Ok() {
+			err = errors.New(cs.Msg)
+		}
+
+		result.Status[cs.ReferenceName.String()] = err
+	}
+
+	if !report.UnpackStatus.Ok() {
+		return result, fmt.Errorf("push failed: %s", report.UnpackStatus.Msg)
+	}
+
+	return result, nil
+}
@@ -2,7 +2,9 @@ package git
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,8 +14,12 @@ import (
 
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
 	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
 	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	"gopkg.in/src-d/go-git.v4/storage/filesystem"
@@ -37,6 +43,15 @@ func (s *RemoteSuite) TestConnect(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *RemoteSuite) TestConnectWithRetry(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	r := newRemote(nil, nil, &config.RemoteConfig{Name: "foo", URL: url})
+
+	err := r.ConnectWithRetry(NewDefaultRetryPolicy())
+	c.Assert(err, IsNil)
+	c.Assert(r.AdvertisedReferences(), NotNil)
+}
+
 func (s *RemoteSuite) TestnewRemoteInvalidEndpoint(c *C) {
 	r := newRemote(nil, nil, &config.RemoteConfig{Name: "foo", URL: "qux"})
 
@@ -106,6 +121,69 @@ func (s *RemoteSuite) TestFetch(c *C) {
 	}
 }
 
+// flakyUploadPackTransport wraps a real transport.Transport so that the
+// first session it hands out fails its UploadPack call (as a dead SSH
+// session would), and every session after that behaves normally. It lets a
+// test prove a retried UploadPack gets a freshly negotiated session instead
+// of being resent on the one that just failed.
+type flakyUploadPackTransport struct {
+	transport.Transport
+	failed   bool
+	sessions int
+}
+
+func (t *flakyUploadPackTransport) NewUploadPackSession(ep transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	t.sessions++
+
+	s, err := t.Transport.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.failed {
+		return s, nil
+	}
+
+	return &flakyUploadPackSession{UploadPackSession: s, transport: t}, nil
+}
+
+type flakyUploadPackSession struct {
+	transport.UploadPackSession
+	transport *flakyUploadPackTransport
+}
+
+func (s *flakyUploadPackSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (io.ReadCloser, error) {
+	s.transport.failed = true
+	return nil, errors.New("read: connection reset by peer")
+}
+
+func (s *RemoteSuite) TestFetchRetryRebuildsDeadSession(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+
+	ep, err := transport.NewEndpoint(url)
+	c.Assert(err, IsNil)
+
+	real, err := client.NewClient(ep)
+	c.Assert(err, IsNil)
+
+	fake := &flakyUploadPackTransport{Transport: real}
+	client.InstallProtocol(ep.Protocol, fake)
+	defer client.InstallProtocol(ep.Protocol, real)
+
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	err = r.Fetch(&FetchOptions{
+		RefSpecs:    []config.RefSpec{refspec},
+		RetryPolicy: &DefaultRetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(fake.sessions, Equals, 2)
+	c.Assert(sto.Objects, Not(HasLen), 0)
+}
+
 func (s *RemoteSuite) TestFetchDepth(c *C) {
 	url := s.GetBasicLocalRepositoryURL()
 	sto := memory.NewStorage()
@@ -132,6 +210,158 @@ func (s *RemoteSuite) TestFetchDepth(c *C) {
 	}
 }
 
+// noShallowStorer satisfies storer.Storer but, unlike memory.Storage,
+// doesn't also implement storer.ShallowStorer.
+type noShallowStorer struct {
+	storer.Storer
+}
+
+func (s *RemoteSuite) TestFetchDepthNotSupported(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := noShallowStorer{memory.NewStorage()}
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	err := r.Fetch(&FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		Depth:    1,
+	})
+	c.Assert(err, Equals, ErrShallowNotSupported)
+}
+
+func (s *RemoteSuite) TestFetchUnshallowNotSupported(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := noShallowStorer{memory.NewStorage()}
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	err := r.Fetch(&FetchOptions{
+		RefSpecs:  []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		Unshallow: true,
+	})
+	c.Assert(err, Equals, ErrShallowNotSupported)
+}
+
+func (s *RemoteSuite) TestFetchDeepen(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	c.Assert(r.Fetch(&FetchOptions{
+		RefSpecs: []config.RefSpec{refspec},
+		Depth:    1,
+	}), IsNil)
+
+	boundary, err := sto.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, Not(HasLen), 0)
+
+	before := len(sto.Objects)
+
+	c.Assert(r.Fetch(&FetchOptions{
+		RefSpecs: []config.RefSpec{refspec},
+		Deepen:   1,
+	}), IsNil)
+
+	c.Assert(len(sto.Objects) > before, Equals, true)
+
+	deepened, err := sto.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(deepened, Not(DeepEquals), boundary)
+}
+
+func (s *RemoteSuite) TestFetchUnshallow(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	c.Assert(r.Fetch(&FetchOptions{
+		RefSpecs: []config.RefSpec{refspec},
+		Depth:    1,
+	}), IsNil)
+
+	boundary, err := sto.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, Not(HasLen), 0)
+
+	c.Assert(r.Fetch(&FetchOptions{
+		RefSpecs:  []config.RefSpec{refspec},
+		Unshallow: true,
+	}), IsNil)
+
+	boundary, err = sto.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, HasLen, 0)
+}
+
+func (s *RemoteSuite) TestFetchShallowSince(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	tip, err := sto.Reference("refs/remotes/origin/master")
+	c.Assert(err, IsNil)
+
+	commit, err := object.GetCommit(sto, tip.Hash())
+	c.Assert(err, IsNil)
+	c.Assert(commit.NumParents(), Not(Equals), 0)
+
+	parent, err := commit.Parent(0)
+	c.Assert(err, IsNil)
+
+	sto2 := memory.NewStorage()
+	r2 := newRemote(sto2, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r2.Connect(), IsNil)
+
+	c.Assert(r2.Fetch(&FetchOptions{
+		RefSpecs:     []config.RefSpec{refspec},
+		ShallowSince: parent.Author.When.Add(time.Second),
+	}), IsNil)
+
+	boundary, err := sto2.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, Not(HasLen), 0)
+}
+
+func (s *RemoteSuite) TestFetchShallowExclude(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	tip, err := sto.Reference("refs/remotes/origin/master")
+	c.Assert(err, IsNil)
+
+	commit, err := object.GetCommit(sto, tip.Hash())
+	c.Assert(err, IsNil)
+	c.Assert(commit.NumParents(), Not(Equals), 0)
+	parent := commit.ParentHashes[0]
+
+	sto2 := memory.NewStorage()
+	r2 := newRemote(sto2, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r2.Connect(), IsNil)
+
+	c.Assert(r2.Fetch(&FetchOptions{
+		RefSpecs:       []config.RefSpec{refspec},
+		ShallowExclude: []string{parent.String()},
+	}), IsNil)
+
+	boundary, err := sto2.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, Not(HasLen), 0)
+}
+
 func (s *RemoteSuite) TestFetchWithProgress(c *C) {
 	url := s.GetBasicLocalRepositoryURL()
 	sto := memory.NewStorage()
@@ -151,6 +381,35 @@ func (s *RemoteSuite) TestFetchWithProgress(c *C) {
 	c.Assert(buf.Len(), Not(Equals), 0)
 }
 
+type recordingProgressReporter struct {
+	NopProgressReporter
+	refUpdates int
+}
+
+func (r *recordingProgressReporter) OnRefUpdate(name plumbing.ReferenceName, old, new plumbing.Hash) {
+	r.refUpdates++
+}
+
+func (s *RemoteSuite) TestFetchWithProgressReporter(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	buf := bytes.NewBuffer(nil)
+
+	r := newRemote(sto, buf, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	reporter := &recordingProgressReporter{}
+	refspec := config.RefSpec("+refs/heads/*:refs/remotes/origin/*")
+	err := r.Fetch(&FetchOptions{
+		RefSpecs:         []config.RefSpec{refspec},
+		ProgressReporter: reporter,
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(reporter.refUpdates, Not(Equals), 0)
+	c.Assert(buf.Len(), Not(Equals), 0)
+}
+
 type mockPackfileWriter struct {
 	Storer
 	PackfileWriterCalled bool
@@ -213,6 +472,225 @@ func (s *RemoteSuite) TestFetchNoErrAlreadyUpToDate(c *C) {
 	c.Assert(err, Equals, NoErrAlreadyUpToDate)
 }
 
+func (s *RemoteSuite) TestPush(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	dir, err := ioutil.TempDir("", "push")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	_, err = PlainInit(dir, true)
+	c.Assert(err, IsNil)
+
+	dst := newRemote(sto, nil, &config.RemoteConfig{Name: "dst", URL: dir})
+	result, err := dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/master"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Status["refs/heads/master"], IsNil)
+
+	// pushing the same ref again is a no-op.
+	_, err = dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/master"},
+	})
+	c.Assert(err, Equals, NoErrAlreadyUpToDate)
+}
+
+// flakyReceivePackTransport is flakyUploadPackTransport's push-side
+// counterpart: the first session it hands out fails its ReceivePack call,
+// every session after that behaves normally.
+type flakyReceivePackTransport struct {
+	transport.Transport
+	failed   bool
+	sessions int
+}
+
+func (t *flakyReceivePackTransport) NewReceivePackSession(ep transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	t.sessions++
+
+	s, err := t.Transport.NewReceivePackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.failed {
+		return s, nil
+	}
+
+	return &flakyReceivePackSession{ReceivePackSession: s, transport: t}, nil
+}
+
+type flakyReceivePackSession struct {
+	transport.ReceivePackSession
+	transport *flakyReceivePackTransport
+}
+
+func (s *flakyReceivePackSession) ReceivePack(ctx context.Context, req *packp.ReferenceUpdateRequest) (*packp.ReportStatus, error) {
+	s.transport.failed = true
+
+	// Drain the packfile pipe so encodePackfile's feeder goroutine doesn't
+	// block forever on a write nobody will ever read.
+	io.Copy(ioutil.Discard, req.Packfile)
+
+	return nil, errors.New("read: connection reset by peer")
+}
+
+func (s *RemoteSuite) TestPushRetryRebuildsDeadSession(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	dir, err := ioutil.TempDir("", "pushretry")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	_, err = PlainInit(dir, true)
+	c.Assert(err, IsNil)
+
+	ep, err := transport.NewEndpoint(dir)
+	c.Assert(err, IsNil)
+
+	real, err := client.NewClient(ep)
+	c.Assert(err, IsNil)
+
+	fake := &flakyReceivePackTransport{Transport: real}
+	client.InstallProtocol(ep.Protocol, fake)
+	defer client.InstallProtocol(ep.Protocol, real)
+
+	dst := newRemote(sto, nil, &config.RemoteConfig{Name: "dst", URL: dir})
+	result, err := dst.Push(&PushOptions{
+		RefSpecs:    []config.RefSpec{"refs/heads/master:refs/heads/master"},
+		RetryPolicy: &DefaultRetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(result.Status["refs/heads/master"], IsNil)
+	c.Assert(fake.sessions, Equals, 2)
+}
+
+// commitParent returns the first parent of the commit advertised as
+// refs/heads/master in sto, so a caller can push an earlier, diverged
+// state of the branch.
+func commitParent(c *C, sto storer.Storer) plumbing.Hash {
+	tip, err := sto.Reference("refs/heads/master")
+	c.Assert(err, IsNil)
+
+	commit, err := object.GetCommit(sto, tip.Hash())
+	c.Assert(err, IsNil)
+	c.Assert(commit.NumParents(), Not(Equals), 0)
+
+	return commit.ParentHashes[0]
+}
+
+func (s *RemoteSuite) TestPushRejectNonFastForward(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	parent := commitParent(c, sto)
+
+	dir, err := ioutil.TempDir("", "push")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	_, err = PlainInit(dir, true)
+	c.Assert(err, IsNil)
+
+	dst := newRemote(sto, nil, &config.RemoteConfig{Name: "dst", URL: dir})
+	_, err = dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/master"},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(sto.SetReference(plumbing.NewHashReference("refs/heads/old", parent)), IsNil)
+
+	_, err = dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/old:refs/heads/master"},
+	})
+	c.Assert(err, Equals, ErrForceNeeded)
+}
+
+func (s *RemoteSuite) TestPushForce(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	parent := commitParent(c, sto)
+
+	dir, err := ioutil.TempDir("", "push")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	_, err = PlainInit(dir, true)
+	c.Assert(err, IsNil)
+
+	dst := newRemote(sto, nil, &config.RemoteConfig{Name: "dst", URL: dir})
+	_, err = dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/master:refs/heads/master"},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(sto.SetReference(plumbing.NewHashReference("refs/heads/old", parent)), IsNil)
+
+	_, err = dst.Push(&PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/old:refs/heads/master"},
+		Force:    true,
+	})
+	c.Assert(err, IsNil)
+}
+
+// TestBuildPushCommandsOnlyWantsMissingObjects guards against a push
+// re-encoding the whole reachable history on every call: once the remote is
+// only missing the commits after its current tip, buildPushCommands must
+// report that tip as a have, so encodePackfile's revlist.Objects call can
+// exclude everything reachable from it.
+func (s *RemoteSuite) TestBuildPushCommandsOnlyWantsMissingObjects(c *C) {
+	url := s.GetBasicLocalRepositoryURL()
+	sto := memory.NewStorage()
+	r := newRemote(sto, nil, &config.RemoteConfig{Name: "foo", URL: url})
+	c.Assert(r.Connect(), IsNil)
+
+	refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+	c.Assert(r.Fetch(&FetchOptions{RefSpecs: []config.RefSpec{refspec}}), IsNil)
+
+	parent := commitParent(c, sto)
+
+	remoteSto := memory.NewStorage()
+	c.Assert(remoteSto.SetReference(plumbing.NewHashReference("refs/heads/master", parent)), IsNil)
+
+	_, wants, haves, err := r.buildPushCommands(remoteSto, &PushOptions{
+		RefSpecs: []config.RefSpec{refspec},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(haves, DeepEquals, []plumbing.Hash{parent})
+
+	full, err := revlist.Objects(sto, wants, nil)
+	c.Assert(err, IsNil)
+
+	incremental, err := revlist.Objects(sto, wants, haves)
+	c.Assert(err, IsNil)
+
+	c.Assert(len(incremental) < len(full), Equals, true)
+}
+
 func (s *RemoteSuite) TestHead(c *C) {
 	url := s.GetBasicLocalRepositoryURL()
 	r := newRemote(nil, nil, &config.RemoteConfig{Name: "foo", URL: url})
@@ -298,4 +776,58 @@ func Example_customHTTPClient() {
 	fmt.Println(head.Hash())
 	// Output:
 	// 6ecf0ef2c2dffb796033e5a02219af86ec6584e5
+
+	// Push to a local bare repository instead of a live remote, so this
+	// example doesn't depend on write access to a shared fixture. Auth is
+	// set to show how credentials flow through to Push; the local file
+	// transport we're pushing over ignores it, but a real HTTP(S) remote
+	// would receive it the same way.
+	dir, err := ioutil.TempDir("", "customHTTPClient")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := PlainInit(dir, true); err != nil {
+		panic(err)
+	}
+
+	if _, err := r.CreateRemote(&config.RemoteConfig{Name: "local", URL: dir}); err != nil {
+		panic(err)
+	}
+
+	_, err = r.Push(&PushOptions{
+		RemoteName: "local",
+		RefSpecs:   []config.RefSpec{"refs/heads/master:refs/heads/master"},
+		Auth:       &githttp.BasicAuth{Username: "go-git", Password: "go-git"},
+	})
+	if err != nil && err != NoErrAlreadyUpToDate {
+		panic(err)
+	}
+}
+
+// Here is an example of fetching through the installed githttp client with
+// a bounded number of retries, so a flaky connection doesn't fail the whole
+// operation on the first dropped connection.
+func Example_retryPolicy() {
+	const url = "https://github.com/git-fixtures/basic.git"
+
+	client.InstallProtocol("https", githttp.NewClient(http.DefaultClient))
+
+	r := NewMemoryRepository()
+	if err := r.Clone(&CloneOptions{
+		URL:         url,
+		RetryPolicy: NewDefaultRetryPolicy(),
+	}); err != nil {
+		panic(err)
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(head.Hash())
+	// Output:
+	// 6ecf0ef2c2dffb796033e5a02219af86ec6584e5
 }
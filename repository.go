@@ -0,0 +1,164 @@
+package git
+
+import (
+	"errors"
+	"io"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// Storer is the interface that a Repository uses to persist objects,
+// references and the rest of the state required to implement a git
+// repository.
+type Storer storer.Storer
+
+// ErrRemoteNotFound is returned by Repository.Remote and Repository.Push
+// when no remote is configured under the requested name.
+var ErrRemoteNotFound = errors.New("remote not found")
+
+// Repository represents a git repository.
+type Repository struct {
+	Storer Storer
+
+	r map[string]*Remote
+}
+
+// Remote returns a Remote, using the name as key, it requires a previous
+// call to CreateRemote.
+func (r *Repository) Remote(name string) (*Remote, error) {
+	remote, ok := r.r[name]
+	if !ok {
+		return nil, ErrRemoteNotFound
+	}
+
+	return remote, nil
+}
+
+// Push pushes changes to the remote named remoteName (defaults to "origin"
+// when empty). Use PushOptions.RefSpecs to control which local refs are
+// pushed and to which remote refs.
+func (r *Repository) Push(o *PushOptions) (*PushResult, error) {
+	name := o.RemoteName
+	if name == "" {
+		name = "origin"
+	}
+
+	remote, err := r.Remote(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.Push(o)
+}
+
+// Shallow returns the commit hashes at the shallow boundary of the
+// repository, as persisted by the last shallow Fetch. It is empty for a
+// repository that isn't shallow, or whose Storer doesn't support shallow
+// history at all. Use Log to walk history starting from one of these
+// commits (or any commit above them) without running into the missing
+// parent objects a shallow Fetch never downloaded.
+//
+// This is a plain slice rather than an iterator: the shallow boundary is
+// bounded by the number of refs involved in a fetch, never large enough to
+// warrant streaming, and every caller so far wants the whole set at once
+// (to build a lookup set, or to compare before/after a Fetch).
+func (r *Repository) Shallow() ([]plumbing.Hash, error) {
+	s, ok := r.Storer.(storer.ShallowStorer)
+	if !ok {
+		return nil, nil
+	}
+
+	return s.Shallow()
+}
+
+// IsShallow reports whether the repository has a shallow boundary.
+func (r *Repository) IsShallow() (bool, error) {
+	boundary, err := r.Shallow()
+	if err != nil {
+		return false, err
+	}
+
+	return len(boundary) > 0, nil
+}
+
+// Log returns an iterator over the commit from and its ancestors. On a
+// shallow repository it stops descending past any commit reported by
+// Shallow instead of trying to resolve parent objects a Fetch never
+// downloaded, so it's always safe to call, shallow or not.
+func (r *Repository) Log(from plumbing.Hash) (object.CommitIter, error) {
+	boundary, err := r.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	shallow := make(map[plumbing.Hash]bool, len(boundary))
+	for _, h := range boundary {
+		shallow[h] = true
+	}
+
+	return &commitIter{
+		s:       r.Storer,
+		stack:   []plumbing.Hash{from},
+		seen:    make(map[plumbing.Hash]bool),
+		shallow: shallow,
+	}, nil
+}
+
+// commitIter implements object.CommitIter over a repository's commit graph,
+// treating every commit in shallow as having no parents rather than trying
+// (and failing) to fetch objects a shallow Fetch never downloaded.
+type commitIter struct {
+	s       Storer
+	stack   []plumbing.Hash
+	seen    map[plumbing.Hash]bool
+	shallow map[plumbing.Hash]bool
+}
+
+func (it *commitIter) Next() (*object.Commit, error) {
+	for len(it.stack) > 0 {
+		h := it.stack[len(it.stack)-1]
+		it.stack = it.stack[:len(it.stack)-1]
+
+		if it.seen[h] {
+			continue
+		}
+		it.seen[h] = true
+
+		c, err := object.GetCommit(it.s, h)
+		if err != nil {
+			return nil, err
+		}
+
+		if !it.shallow[h] {
+			it.stack = append(it.stack, c.ParentHashes...)
+		}
+
+		return c, nil
+	}
+
+	return nil, io.EOF
+}
+
+func (it *commitIter) ForEach(cb func(*object.Commit) error) error {
+	for {
+		c, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := cb(c); err != nil {
+			if err == storer.ErrStop {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func (it *commitIter) Close() {}
@@ -0,0 +1,107 @@
+package git
+
+import (
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+
+	. "gopkg.in/check.v1"
+)
+
+type RepositorySuite struct{}
+
+var _ = Suite(&RepositorySuite{})
+
+func buildTestCommit(sto storer.EncodedObjectStorer, parents ...plumbing.Hash) plumbing.Hash {
+	commit := &object.Commit{
+		Author:       object.Signature{Name: "foo", Email: "foo@foo.com"},
+		Committer:    object.Signature{Name: "foo", Email: "foo@foo.com"},
+		Message:      "foo",
+		TreeHash:     plumbing.ZeroHash,
+		ParentHashes: parents,
+	}
+
+	obj := sto.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		panic(err)
+	}
+
+	h, err := sto.SetEncodedObject(obj)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+func (s *RepositorySuite) TestShallowNotShallow(c *C) {
+	repo := &Repository{Storer: memory.NewStorage()}
+
+	boundary, err := repo.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, HasLen, 0)
+
+	isShallow, err := repo.IsShallow()
+	c.Assert(err, IsNil)
+	c.Assert(isShallow, Equals, false)
+}
+
+func (s *RepositorySuite) TestShallow(c *C) {
+	sto := memory.NewStorage()
+	repo := &Repository{Storer: sto}
+
+	want := []plumbing.Hash{plumbing.NewHash("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")}
+	c.Assert(sto.SetShallow(want), IsNil)
+
+	boundary, err := repo.Shallow()
+	c.Assert(err, IsNil)
+	c.Assert(boundary, DeepEquals, want)
+
+	isShallow, err := repo.IsShallow()
+	c.Assert(err, IsNil)
+	c.Assert(isShallow, Equals, true)
+}
+
+func (s *RepositorySuite) TestLog(c *C) {
+	sto := memory.NewStorage()
+	root := buildTestCommit(sto)
+	middle := buildTestCommit(sto, root)
+	tip := buildTestCommit(sto, middle)
+
+	repo := &Repository{Storer: sto}
+
+	iter, err := repo.Log(tip)
+	c.Assert(err, IsNil)
+
+	var hashes []plumbing.Hash
+	c.Assert(iter.ForEach(func(commit *object.Commit) error {
+		hashes = append(hashes, commit.Hash)
+		return nil
+	}), IsNil)
+	c.Assert(hashes, DeepEquals, []plumbing.Hash{tip, middle, root})
+}
+
+func (s *RepositorySuite) TestLogStopsAtShallowBoundary(c *C) {
+	sto := memory.NewStorage()
+
+	// root is never stored, the way a shallow Fetch never downloads the
+	// objects behind its boundary.
+	root := plumbing.NewHash("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	middle := buildTestCommit(sto, root)
+	tip := buildTestCommit(sto, middle)
+
+	c.Assert(sto.SetShallow([]plumbing.Hash{middle}), IsNil)
+
+	repo := &Repository{Storer: sto}
+
+	iter, err := repo.Log(tip)
+	c.Assert(err, IsNil)
+
+	var hashes []plumbing.Hash
+	c.Assert(iter.ForEach(func(commit *object.Commit) error {
+		hashes = append(hashes, commit.Hash)
+		return nil
+	}), IsNil)
+	c.Assert(hashes, DeepEquals, []plumbing.Hash{tip, middle})
+}
@@ -0,0 +1,120 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides whether a failed network operation against a remote
+// should be retried, and how long to wait before trying again. attempt is
+// 1 for the first retry (the initial, non-retried call isn't counted).
+type RetryPolicy interface {
+	// ShouldRetry is called after a failed attempt. If retry is false, wait
+	// is ignored and the error is returned to the caller as-is.
+	ShouldRetry(attempt int, err error) (wait time.Duration, retry bool)
+}
+
+// DefaultRetryPolicy retries classified transient errors up to MaxAttempts
+// times, waiting an exponentially increasing delay (capped at MaxBackoff,
+// with up to 50% random jitter) between attempts.
+type DefaultRetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// NewDefaultRetryPolicy returns a DefaultRetryPolicy with sane defaults: up
+// to 5 retries after the initial call, starting at a 200ms backoff that doubles every attempt and
+// is capped at 30s.
+func NewDefaultRetryPolicy() *DefaultRetryPolicy {
+	return &DefaultRetryPolicy{
+		MaxAttempts: 5,
+		BaseBackoff: 200 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+func (p *DefaultRetryPolicy) ShouldRetry(attempt int, err error) (time.Duration, bool) {
+	if attempt > p.MaxAttempts || !isTransientError(err) {
+		return 0, false
+	}
+
+	backoff := float64(p.BaseBackoff) * math.Pow(2, float64(attempt-1))
+	if max := float64(p.MaxBackoff); backoff > max {
+		backoff = max
+	}
+
+	jitter := rand.Int63n(int64(backoff)/2 + 1)
+	return time.Duration(backoff)/2 + time.Duration(jitter), true
+}
+
+// http5xxPattern matches the status line go-git's http transport reports
+// for a non-2xx response, e.g. `... status code: 502`.
+var http5xxPattern = regexp.MustCompile(`status code: 5\d\d\b`)
+
+// isTransientError reports whether err looks like a temporary network or
+// server failure that's worth retrying: a dial/read timeout, a connection
+// reset, an EOF dropped mid-transfer (as SSH sessions do on a flaky link),
+// an HTTP 5xx response, or any exceeded context deadline (withRetry itself
+// stops once the caller's own ctx is done). It never retries a
+// caller-initiated cancellation.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset by peer") ||
+		strings.Contains(msg, "broken pipe") ||
+		http5xxPattern.MatchString(msg)
+}
+
+// withRetry runs op, retrying it according to policy until it succeeds, the
+// policy gives up, or ctx is done. A nil policy disables retrying entirely.
+func withRetry(ctx context.Context, policy RetryPolicy, op func() error) error {
+	if policy == nil {
+		return op()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		wait, retry := policy.ShouldRetry(attempt, err)
+		if !retry {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
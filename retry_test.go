@@ -0,0 +1,113 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+type fakeNetError struct {
+	timeout, temporary bool
+}
+
+func (e *fakeNetError) Error() string   { return "fake net error" }
+func (e *fakeNetError) Timeout() bool   { return e.timeout }
+func (e *fakeNetError) Temporary() bool { return e.temporary }
+
+func (s *RetrySuite) TestIsTransientError(c *C) {
+	c.Assert(isTransientError(nil), Equals, false)
+	c.Assert(isTransientError(context.Canceled), Equals, false)
+	c.Assert(isTransientError(context.DeadlineExceeded), Equals, true)
+	c.Assert(isTransientError(io.EOF), Equals, true)
+	c.Assert(isTransientError(io.ErrUnexpectedEOF), Equals, true)
+	c.Assert(isTransientError(&fakeNetError{timeout: true}), Equals, true)
+	c.Assert(isTransientError(&fakeNetError{temporary: true}), Equals, true)
+	c.Assert(isTransientError(&fakeNetError{}), Equals, false)
+	c.Assert(isTransientError(errors.New("write: broken pipe")), Equals, true)
+	c.Assert(isTransientError(errors.New("read: connection reset by peer")), Equals, true)
+	c.Assert(isTransientError(errors.New(`unexpected requesting "https://example.com/info/refs" status code: 500`)), Equals, true)
+	c.Assert(isTransientError(errors.New(`unexpected requesting "https://example.com/info/refs" status code: 503`)), Equals, true)
+	c.Assert(isTransientError(errors.New(`unexpected requesting "https://example.com/info/refs" status code: 404`)), Equals, false)
+	c.Assert(isTransientError(errors.New("permission denied")), Equals, false)
+}
+
+func (s *RetrySuite) TestDefaultRetryPolicyShouldRetry(c *C) {
+	p := &DefaultRetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	_, retry := p.ShouldRetry(1, errors.New("not transient"))
+	c.Assert(retry, Equals, false)
+
+	wait, retry := p.ShouldRetry(1, io.ErrUnexpectedEOF)
+	c.Assert(retry, Equals, true)
+	c.Assert(wait <= p.MaxBackoff, Equals, true)
+
+	_, retry = p.ShouldRetry(p.MaxAttempts+1, io.ErrUnexpectedEOF)
+	c.Assert(retry, Equals, false)
+}
+
+func (s *RetrySuite) TestWithRetrySucceedsAfterTransientFailures(c *C) {
+	policy := &DefaultRetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	var calls int
+	err := withRetry(context.Background(), policy, func() error {
+		calls++
+		if calls < 3 {
+			return io.ErrUnexpectedEOF
+		}
+
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetrySuite) TestWithRetryGivesUpOnNonTransientError(c *C) {
+	policy := &DefaultRetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	wantErr := errors.New("boom")
+
+	var calls int
+	err := withRetry(context.Background(), policy, func() error {
+		calls++
+		return wantErr
+	})
+
+	c.Assert(err, Equals, wantErr)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestWithRetryNilPolicyDisablesRetrying(c *C) {
+	wantErr := errors.New("boom")
+
+	var calls int
+	err := withRetry(context.Background(), nil, func() error {
+		calls++
+		return wantErr
+	})
+
+	c.Assert(err, Equals, wantErr)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestWithRetryStopsWhenContextDone(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	policy := &DefaultRetryPolicy{MaxAttempts: 5, BaseBackoff: time.Second, MaxBackoff: time.Second}
+
+	var calls int
+	err := withRetry(ctx, policy, func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	c.Assert(calls, Equals, 1)
+}